@@ -0,0 +1,314 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ContainersCountKey is the key for the container-count-by-state metric.
+	ContainersCountKey = "docker_containers"
+	// ImageCountKey is the key for the total image count metric.
+	ImageCountKey = "docker_images"
+	// ImageSizeBytesKey is the key for the total size of images on disk.
+	ImageSizeBytesKey = "docker_image_size_bytes"
+	// DanglingImagesKey is the key for the dangling image count metric.
+	DanglingImagesKey = "docker_dangling_images"
+	// NetworkEndpointsKey is the key for the network endpoint count metric.
+	NetworkEndpointsKey = "docker_network_endpoints"
+
+	// containersLoaderName and imagesLoaderName are the cache bucket names
+	// the built-in loaders are registered under.
+	containersLoaderName = "containers"
+	imagesLoaderName     = "images"
+	networksLoaderName   = "networks"
+
+	// defaultLoaderTTL bounds how often the built-in loaders are allowed to
+	// call into the docker daemon, regardless of scrape frequency.
+	defaultLoaderTTL = 1 * time.Minute
+
+	// scrapeTimeout bounds how long a single Prometheus scrape will wait
+	// on a loader whose TTL has expired. A stalled docker daemon then
+	// degrades the one metric it backs instead of hanging the whole
+	// /metrics response.
+	scrapeTimeout = 10 * time.Second
+
+	// loaderErrorBackoff bounds how soon a failing loader is retried, so a
+	// stalled docker daemon costs one slow scrape per backoff window
+	// instead of one on every single scrape.
+	loaderErrorBackoff = 15 * time.Second
+)
+
+var (
+	containersDesc = metrics.NewDesc(
+		metrics.BuildFQName("", kubeletSubsystem, ContainersCountKey),
+		"Number of containers known to the Docker daemon, by state.",
+		[]string{"state"}, nil,
+		metrics.ALPHA, "")
+	imageCountDesc = metrics.NewDesc(
+		metrics.BuildFQName("", kubeletSubsystem, ImageCountKey),
+		"Number of images known to the Docker daemon.",
+		nil, nil,
+		metrics.ALPHA, "")
+	imageSizeBytesDesc = metrics.NewDesc(
+		metrics.BuildFQName("", kubeletSubsystem, ImageSizeBytesKey),
+		"Total size, in bytes, of all images known to the Docker daemon.",
+		nil, nil,
+		metrics.ALPHA, "")
+	danglingImagesDesc = metrics.NewDesc(
+		metrics.BuildFQName("", kubeletSubsystem, DanglingImagesKey),
+		"Number of images with no referencing repo tag.",
+		nil, nil,
+		metrics.ALPHA, "")
+	networkEndpointsDesc = metrics.NewDesc(
+		metrics.BuildFQName("", kubeletSubsystem, NetworkEndpointsKey),
+		"Number of endpoints across all Docker networks.",
+		nil, nil,
+		metrics.ALPHA, "")
+)
+
+// MetricValues is the set the expensive, docker-daemon-backed values a
+// MetricsLoaderFn reports back to its cache entry. A loader only needs to
+// set the fields it is responsible for; a nil field means "not collected
+// by this loader" rather than zero.
+type MetricValues struct {
+	// ContainersByState is the number of containers in each state
+	// ("running", "exited", "created", ...).
+	ContainersByState map[string]float64
+	// ImageCount is the total number of images known to the docker daemon.
+	ImageCount *float64
+	// ImageSizeBytes is the total size on disk of all images.
+	ImageSizeBytes *float64
+	// DanglingImages is the number of images with no referencing repo tag.
+	DanglingImages *float64
+	// NetworkEndpoints is the number of endpoints across all docker
+	// networks.
+	NetworkEndpoints *float64
+}
+
+// MetricsLoaderFn populates an empty MetricValues by calling into the
+// docker daemon. It is only invoked when its cache entry's TTL has
+// expired, so it may be as expensive as it needs to be.
+type MetricsLoaderFn func(ctx context.Context, m *MetricValues) error
+
+// loaderEntry pairs a registered MetricsLoaderFn with the values it last
+// produced and the time those values expire.
+type loaderEntry struct {
+	ttl time.Duration
+	fn  MetricsLoaderFn
+
+	mu     sync.Mutex
+	expiry time.Time
+	values MetricValues
+}
+
+// get returns the cached values, refreshing them by calling e.fn if the
+// TTL has expired. e.fn is not required to respect ctx (the built-in
+// loaders call into a docker client with no context support), so the
+// call is made on its own goroutine and raced against ctx.Done(): a
+// loader that doesn't return before the scrape deadline leaves the cache
+// stale until backoff() has elapsed rather than blocking the scrape.
+func (e *loaderEntry) get(ctx context.Context) MetricValues {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Now().Before(e.expiry) {
+		return e.values
+	}
+
+	values := MetricValues{}
+	done := make(chan error, 1)
+	go func() { done <- e.fn(ctx, &values) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			klog.ErrorS(err, "Failed to refresh cached docker metrics, serving stale values")
+			e.expiry = time.Now().Add(e.backoff())
+			return e.values
+		}
+		e.values = values
+		e.expiry = time.Now().Add(e.ttl)
+		return e.values
+	case <-ctx.Done():
+		klog.ErrorS(ctx.Err(), "Docker metrics loader did not return before the scrape deadline, serving stale values")
+		e.expiry = time.Now().Add(e.backoff())
+		return e.values
+	}
+}
+
+// backoff returns how long to wait before retrying a loader that just
+// failed or timed out, capped at the loader's own TTL so a short-TTL
+// metric never backs off longer than it would have refreshed anyway.
+func (e *loaderEntry) backoff() time.Duration {
+	if e.ttl < loaderErrorBackoff {
+		return e.ttl
+	}
+	return loaderErrorBackoff
+}
+
+// metricsCache holds one loaderEntry per registered name and refreshes
+// each independently according to its own TTL, so that a scrape only pays
+// the cost of calling the docker daemon for metrics whose TTL has expired.
+type metricsCache struct {
+	mu      sync.RWMutex
+	loaders map[string]*loaderEntry
+}
+
+func newMetricsCache() *metricsCache {
+	return &metricsCache{loaders: make(map[string]*loaderEntry)}
+}
+
+func (c *metricsCache) register(name string, ttl time.Duration, fn MetricsLoaderFn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaders[name] = &loaderEntry{ttl: ttl, fn: fn}
+}
+
+func (c *metricsCache) snapshot(ctx context.Context) []MetricValues {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	values := make([]MetricValues, 0, len(c.loaders))
+	for _, entry := range c.loaders {
+		values = append(values, entry.get(ctx))
+	}
+	return values
+}
+
+// loaderCache backs RegisterLoader and the cachedCollector registered by
+// Register. It is package-level because both callers of RegisterLoader and
+// the collector consulted on every scrape need to share it.
+var loaderCache = newMetricsCache()
+
+// RegisterLoader registers fn to populate the cache bucket name; fn is
+// only called again once ttl has elapsed since its last successful run, so
+// that repeated Prometheus scrapes don't translate into repeated calls
+// into the docker daemon. A run that fails or misses the scrape deadline
+// is retried after the shorter of ttl and loaderErrorBackoff.
+func RegisterLoader(name string, ttl time.Duration, fn MetricsLoaderFn) {
+	loaderCache.register(name, ttl, fn)
+}
+
+// cachedCollector is a metrics.StableCollector that, on every scrape,
+// consults loaderCache instead of updating on every docker operation.
+type cachedCollector struct {
+	metrics.BaseStableCollector
+}
+
+var _ metrics.StableCollector = &cachedCollector{}
+
+func (c *cachedCollector) DescribeWithStability(ch chan<- *metrics.Desc) {
+	ch <- containersDesc
+	ch <- imageCountDesc
+	ch <- imageSizeBytesDesc
+	ch <- danglingImagesDesc
+	ch <- networkEndpointsDesc
+}
+
+func (c *cachedCollector) CollectWithStability(ch chan<- metrics.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+
+	for _, values := range loaderCache.snapshot(ctx) {
+		for state, count := range values.ContainersByState {
+			ch <- metrics.NewLazyConstMetric(containersDesc, metrics.GaugeValue, count, state)
+		}
+		if values.ImageCount != nil {
+			ch <- metrics.NewLazyConstMetric(imageCountDesc, metrics.GaugeValue, *values.ImageCount)
+		}
+		if values.ImageSizeBytes != nil {
+			ch <- metrics.NewLazyConstMetric(imageSizeBytesDesc, metrics.GaugeValue, *values.ImageSizeBytes)
+		}
+		if values.DanglingImages != nil {
+			ch <- metrics.NewLazyConstMetric(danglingImagesDesc, metrics.GaugeValue, *values.DanglingImages)
+		}
+		if values.NetworkEndpoints != nil {
+			ch <- metrics.NewLazyConstMetric(networkEndpointsDesc, metrics.GaugeValue, *values.NetworkEndpoints)
+		}
+	}
+}
+
+// dockerStatsClient is the subset of the dockershim docker client needed
+// to populate the built-in container/image/network loaders below. It is
+// satisfied by libdocker.Interface, whose methods (like the upstream
+// docker client they wrap) do not take a context; the scrapeTimeout bound
+// on a stalled call is enforced by loaderEntry.get instead.
+type dockerStatsClient interface {
+	ListContainers(options dockertypes.ContainerListOptions) ([]dockertypes.Container, error)
+	ListImages(options dockertypes.ImageListOptions) ([]dockertypes.ImageSummary, error)
+	ListNetworks(options dockertypes.NetworkListOptions) ([]dockertypes.NetworkResource, error)
+}
+
+// RegisterDockerLoaders wires the built-in container-count, image-count,
+// and network-endpoint loaders against client, so /metrics cost stays
+// bounded by defaultLoaderTTL rather than by scrape frequency.
+func RegisterDockerLoaders(client dockerStatsClient) {
+	RegisterLoader(containersLoaderName, defaultLoaderTTL, func(_ context.Context, m *MetricValues) error {
+		containers, err := client.ListContainers(dockertypes.ContainerListOptions{All: true})
+		if err != nil {
+			return err
+		}
+		byState := make(map[string]float64)
+		for _, c := range containers {
+			byState[c.State]++
+		}
+		m.ContainersByState = byState
+		return nil
+	})
+
+	RegisterLoader(imagesLoaderName, defaultLoaderTTL, func(_ context.Context, m *MetricValues) error {
+		images, err := client.ListImages(dockertypes.ImageListOptions{All: true})
+		if err != nil {
+			return err
+		}
+		var count, sizeBytes, dangling float64
+		for _, img := range images {
+			count++
+			sizeBytes += float64(img.Size)
+			if len(img.RepoTags) == 0 || (len(img.RepoTags) == 1 && img.RepoTags[0] == "<none>:<none>") {
+				dangling++
+			}
+		}
+		m.ImageCount = &count
+		m.ImageSizeBytes = &sizeBytes
+		m.DanglingImages = &dangling
+		return nil
+	})
+
+	RegisterLoader(networksLoaderName, defaultLoaderTTL, func(_ context.Context, m *MetricValues) error {
+		networks, err := client.ListNetworks(dockertypes.NetworkListOptions{Filters: filters.NewArgs()})
+		if err != nil {
+			return err
+		}
+		var endpoints float64
+		for _, n := range networks {
+			endpoints += float64(len(n.Containers))
+		}
+		m.NetworkEndpoints = &endpoints
+		return nil
+	})
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	cbmetrics "k8s.io/component-base/metrics"
+)
+
+// TestLoaderEntryBacksOffOnError verifies that a loader which keeps
+// failing is only retried once per backoff window, not on every get(),
+// which is what would make a stalled docker daemon cost a slow call on
+// every single scrape.
+func TestLoaderEntryBacksOffOnError(t *testing.T) {
+	calls := 0
+	entry := &loaderEntry{
+		ttl: time.Hour,
+		fn: func(_ context.Context, _ *MetricValues) error {
+			calls++
+			return errors.New("docker daemon unavailable")
+		},
+	}
+	ctx := context.Background()
+
+	entry.get(ctx)
+	if calls != 1 {
+		t.Fatalf("expected the first get() to invoke the loader once, got %d calls", calls)
+	}
+
+	entry.get(ctx)
+	if calls != 1 {
+		t.Fatalf("expected get() to serve stale values during the backoff window, got %d calls", calls)
+	}
+
+	entry.mu.Lock()
+	entry.expiry = time.Now().Add(-time.Second)
+	entry.mu.Unlock()
+
+	entry.get(ctx)
+	if calls != 2 {
+		t.Fatalf("expected get() to retry the loader once the backoff window elapsed, got %d calls", calls)
+	}
+}
+
+// TestLoaderEntryRefreshesAfterTTL verifies that a successful loader is
+// cached until its TTL expires, and called again afterwards.
+func TestLoaderEntryRefreshesAfterTTL(t *testing.T) {
+	calls := 0
+	entry := &loaderEntry{
+		ttl: 10 * time.Millisecond,
+		fn: func(_ context.Context, m *MetricValues) error {
+			calls++
+			count := float64(calls)
+			m.ImageCount = &count
+			return nil
+		},
+	}
+
+	values := entry.get(context.Background())
+	if values.ImageCount == nil || *values.ImageCount != 1 {
+		t.Fatalf("expected the first refresh to report ImageCount=1, got %+v", values)
+	}
+
+	values = entry.get(context.Background())
+	if values.ImageCount == nil || *values.ImageCount != 1 {
+		t.Fatalf("expected get() within the TTL to serve the cached value, got %+v", values)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	values = entry.get(context.Background())
+	if values.ImageCount == nil || *values.ImageCount != 2 {
+		t.Fatalf("expected the refresh after TTL expiry to report ImageCount=2, got %+v", values)
+	}
+}
+
+// TestMetricsCacheSnapshotRespectsScrapeDeadline verifies that a loader
+// which never returns doesn't block a snapshot past its context deadline
+// — the case this exists to prevent is a stalled docker daemon hanging
+// the whole /metrics response.
+func TestMetricsCacheSnapshotRespectsScrapeDeadline(t *testing.T) {
+	cache := newMetricsCache()
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	cache.register("slow", time.Hour, func(_ context.Context, _ *MetricValues) error {
+		<-unblock
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	cache.snapshot(ctx)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected snapshot to return once the scrape deadline elapsed, took %v", elapsed)
+	}
+}
+
+// TestCachedCollectorCollectsRegisteredLoaders drives a loader through the
+// public RegisterLoader entry point and confirms cachedCollector emits a
+// metric built from its values on CollectWithStability.
+func TestCachedCollectorCollectsRegisteredLoaders(t *testing.T) {
+	name := "test-" + t.Name()
+	RegisterLoader(name, time.Hour, func(_ context.Context, m *MetricValues) error {
+		count := 3.0
+		m.ImageCount = &count
+		return nil
+	})
+	t.Cleanup(func() {
+		loaderCache.mu.Lock()
+		delete(loaderCache.loaders, name)
+		loaderCache.mu.Unlock()
+	})
+
+	// Registering the collector initializes its descriptors, which the
+	// const metrics built in CollectWithStability are created from.
+	collector := &cachedCollector{}
+	cbmetrics.NewKubeRegistry().CustomMustRegister(collector)
+
+	ch := make(chan cbmetrics.Metric, 16)
+	collector.CollectWithStability(ch)
+	close(ch)
+
+	wantName := fmt.Sprintf("fqName: %q", cbmetrics.BuildFQName("", kubeletSubsystem, ImageCountKey))
+	var sawImageCount bool
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), wantName) {
+			sawImageCount = true
+		}
+	}
+	if !sawImageCount {
+		t.Errorf("expected CollectWithStability to emit %s for the registered loader", ImageCountKey)
+	}
+}
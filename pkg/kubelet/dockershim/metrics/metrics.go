@@ -17,9 +17,14 @@ limitations under the License.
 package metrics
 
 import (
+	"context"
+	"errors"
+	"net"
 	"sync"
 	"time"
 
+	"github.com/docker/docker/errdefs"
+
 	"k8s.io/component-base/metrics"
 	"k8s.io/component-base/metrics/legacyregistry"
 )
@@ -33,6 +38,10 @@ const (
 	DockerOperationsErrorsKey = "docker_operations_errors_total"
 	// DockerOperationsTimeoutKey is the key for the operation timeout metrics.
 	DockerOperationsTimeoutKey = "docker_operations_timeout_total"
+	// DockerOperationsInFlightKey is the key for the operations in flight metrics.
+	DockerOperationsInFlightKey = "docker_operations_in_flight"
+	// DockerOperationDeadlineConsumedRatioKey is the key for the operation deadline metrics.
+	DockerOperationDeadlineConsumedRatioKey = "docker_operation_deadline_consumed_ratio"
 
 	// DeprecatedDockerOperationsKey is the deprecated key for docker operation metrics.
 	DeprecatedDockerOperationsKey = "docker_operations"
@@ -45,6 +54,31 @@ const (
 
 	// Keep the "kubelet" subsystem for backward compatibility.
 	kubeletSubsystem = "kubelet"
+
+	// errorTypeNotFound is used when the requested object (container, image,
+	// network, ...) does not exist.
+	errorTypeNotFound = "not_found"
+	// errorTypeAlreadyExists is used when the operation conflicts with an
+	// object that already exists.
+	errorTypeAlreadyExists = "already_exists"
+	// errorTypeUnauthorized is used when the docker daemon rejects the
+	// request because of missing or invalid credentials.
+	errorTypeUnauthorized = "unauthorized"
+	// errorTypeConflict is used when the operation conflicts with the
+	// current state of the object it targets.
+	errorTypeConflict = "conflict"
+	// errorTypeTimeout is used when the operation did not complete within
+	// its deadline.
+	errorTypeTimeout = "timeout"
+	// errorTypeConnectionReset is used when the connection to the docker
+	// daemon was reset or refused, or otherwise failed at the network
+	// level other than by timing out.
+	errorTypeConnectionReset = "connection_reset"
+	// errorTypeContextCanceled is used when the caller canceled the
+	// operation before it completed.
+	errorTypeContextCanceled = "context_canceled"
+	// errorTypeUnknown is used when none of the above classes apply.
+	errorTypeUnknown = "unknown"
 )
 
 var (
@@ -71,15 +105,15 @@ var (
 		[]string{"operation_type"},
 	)
 	// DockerOperationsErrors collects operation errors by operation
-	// type.
+	// type and error type.
 	DockerOperationsErrors = metrics.NewCounterVec(
 		&metrics.CounterOpts{
 			Subsystem:      kubeletSubsystem,
 			Name:           DockerOperationsErrorsKey,
-			Help:           "Cumulative number of Docker operation errors by operation type.",
+			Help:           "Cumulative number of Docker operation errors by operation type and error type.",
 			StabilityLevel: metrics.ALPHA,
 		},
-		[]string{"operation_type"},
+		[]string{"operation_type", "error_type"},
 	)
 	// DockerOperationsTimeout collects operation timeouts by operation type.
 	DockerOperationsTimeout = metrics.NewCounterVec(
@@ -91,6 +125,32 @@ var (
 		},
 		[]string{"operation_type"},
 	)
+	// DockerOperationsInFlight tracks the number of Docker operations
+	// currently in progress, by operation type. This stays populated even
+	// when the docker daemon has stalled and no operation is completing,
+	// so it can surface a hang that the latency and error metrics cannot.
+	DockerOperationsInFlight = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      kubeletSubsystem,
+			Name:           DockerOperationsInFlightKey,
+			Help:           "Number of Docker operations currently in flight, by operation type.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation_type"},
+	)
+	// DockerOperationDeadlineConsumedRatio collects, for operations that
+	// run against a configured deadline, the fraction of that deadline
+	// consumed before the operation completed, by operation type.
+	DockerOperationDeadlineConsumedRatio = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      kubeletSubsystem,
+			Name:           DockerOperationDeadlineConsumedRatioKey,
+			Help:           "Fraction of the configured deadline consumed by a Docker operation before it completed, by operation type.",
+			Buckets:        []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1.0, 1.5, 2.0},
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation_type"},
+	)
 
 	// DeprecatedDockerOperationsLatency collects operation latency numbers by operation
 	// type.
@@ -116,16 +176,16 @@ var (
 		[]string{"operation_type"},
 	)
 	// DeprecatedDockerOperationsErrors collects operation errors by operation
-	// type.
+	// type and error type.
 	DeprecatedDockerOperationsErrors = metrics.NewCounterVec(
 		&metrics.CounterOpts{
 			Subsystem:         kubeletSubsystem,
 			Name:              DeprecatedDockerOperationsErrorsKey,
-			Help:              "Cumulative number of Docker operation errors by operation type.",
+			Help:              "Cumulative number of Docker operation errors by operation type and error type.",
 			StabilityLevel:    metrics.ALPHA,
 			DeprecatedVersion: "1.14.0",
 		},
-		[]string{"operation_type"},
+		[]string{"operation_type", "error_type"},
 	)
 	// DeprecatedDockerOperationsTimeout collects operation timeouts by operation type.
 	DeprecatedDockerOperationsTimeout = metrics.NewCounterVec(
@@ -149,10 +209,17 @@ func Register() {
 		legacyregistry.MustRegister(DockerOperations)
 		legacyregistry.MustRegister(DockerOperationsErrors)
 		legacyregistry.MustRegister(DockerOperationsTimeout)
+		legacyregistry.MustRegister(DockerOperationsInFlight)
+		legacyregistry.MustRegister(DockerOperationDeadlineConsumedRatio)
+		legacyregistry.MustRegister(RuntimeOperations)
+		legacyregistry.MustRegister(RuntimeOperationsLatency)
+		legacyregistry.MustRegister(RuntimeOperationsErrors)
+		legacyregistry.MustRegister(RuntimeOperationsTimeout)
 		legacyregistry.MustRegister(DeprecatedDockerOperationsLatency)
 		legacyregistry.MustRegister(DeprecatedDockerOperations)
 		legacyregistry.MustRegister(DeprecatedDockerOperationsErrors)
 		legacyregistry.MustRegister(DeprecatedDockerOperationsTimeout)
+		legacyregistry.CustomMustRegister(&cachedCollector{})
 	})
 }
 
@@ -165,3 +232,105 @@ func SinceInMicroseconds(start time.Time) float64 {
 func SinceInSeconds(start time.Time) float64 {
 	return time.Since(start).Seconds()
 }
+
+// RecordError records that the operation op failed with err by
+// incrementing DockerOperationsErrors (and its deprecated twin) with the
+// error classified into a small, bounded set of reason strings. Call
+// sites only need to call this once instead of reimplementing the
+// classification themselves.
+func RecordError(op string, err error) {
+	if err == nil {
+		return
+	}
+	errorType := classifyError(err)
+	DockerOperationsErrors.WithLabelValues(op, errorType).Inc()
+	DeprecatedDockerOperationsErrors.WithLabelValues(op, errorType).Inc()
+	RuntimeOperationsErrors.WithLabelValues(dockerRuntimeName, op, errorType).Inc()
+}
+
+// classifyError maps a docker client error into one of a small, closed
+// set of reason strings so that the error_type label on
+// DockerOperationsErrors stays bounded regardless of the number of
+// distinct error messages the docker daemon can return.
+func classifyError(err error) string {
+	switch {
+	case errdefs.IsNotFound(err):
+		return errorTypeNotFound
+	case errdefs.IsConflict(err):
+		return errorTypeConflict
+	case errdefs.IsAlreadyExists(err):
+		return errorTypeAlreadyExists
+	case errdefs.IsUnauthorized(err):
+		return errorTypeUnauthorized
+	case errdefs.IsDeadline(err), errors.Is(err, context.DeadlineExceeded):
+		return errorTypeTimeout
+	case errors.Is(err, context.Canceled):
+		return errorTypeContextCanceled
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return errorTypeTimeout
+		}
+		return errorTypeConnectionReset
+	}
+
+	return errorTypeUnknown
+}
+
+// RecordOperation marks the start of a Docker operation identified by op:
+// it increments DockerOperations and DockerOperationsInFlight, and returns
+// a closure that call sites should invoke with the resulting error once
+// the operation completes. The closure decrements DockerOperationsInFlight
+// and records latency, error class, and timeout, e.g.:
+//
+//	recordOperation := RecordOperation(operationCreateContainer)
+//	ctr, err := ds.client.CreateContainer(...)
+//	recordOperation(err)
+//
+// DockerOperations* is kept as a thin wrapper around the runtime-agnostic
+// runtime_operations_* series (recorded with runtime="docker") so that
+// existing Docker dashboards keep working while new dashboards can use the
+// runtime-labeled series to cover containerd and CRI-O as well.
+func RecordOperation(op string) func(err error) {
+	start := time.Now()
+	DockerOperations.WithLabelValues(op).Inc()
+	DeprecatedDockerOperations.WithLabelValues(op).Inc()
+	DockerOperationsInFlight.WithLabelValues(op).Inc()
+	RuntimeOperations.WithLabelValues(dockerRuntimeName, op).Inc()
+
+	return func(err error) {
+		DockerOperationsInFlight.WithLabelValues(op).Dec()
+		latency := SinceInSeconds(start)
+		DockerOperationsLatency.WithLabelValues(op).Observe(latency)
+		DeprecatedDockerOperationsLatency.WithLabelValues(op).Observe(SinceInMicroseconds(start))
+		RuntimeOperationsLatency.WithLabelValues(dockerRuntimeName, op).Observe(latency)
+
+		if err == nil {
+			return
+		}
+		RecordError(op, err)
+		if classifyError(err) == errorTypeTimeout {
+			DockerOperationsTimeout.WithLabelValues(op).Inc()
+			DeprecatedDockerOperationsTimeout.WithLabelValues(op).Inc()
+			RuntimeOperationsTimeout.WithLabelValues(dockerRuntimeName, op).Inc()
+		}
+	}
+}
+
+// RecordOperationWithDeadline behaves like RecordOperation, but additionally
+// observes in DockerOperationDeadlineConsumedRatio how much of the given deadline
+// was consumed once the operation completes. Pass the same deadline used to
+// construct the context for the call so the two stay in sync.
+func RecordOperationWithDeadline(op string, deadline time.Duration) func(err error) {
+	start := time.Now()
+	recordOperation := RecordOperation(op)
+
+	return func(err error) {
+		recordOperation(err)
+		if deadline > 0 {
+			DockerOperationDeadlineConsumedRatio.WithLabelValues(op).Observe(SinceInSeconds(start) / deadline.Seconds())
+		}
+	}
+}
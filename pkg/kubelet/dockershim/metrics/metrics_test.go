@@ -0,0 +1,118 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+// TestDockerRuntimeOperationsAgree verifies that DockerOperations* keeps
+// working as a thin wrapper: scraping the registry must show the same
+// value under the legacy docker_operations_* names and the new
+// runtime-labeled runtime_operations_* names, so dashboards built on
+// either one see the same numbers.
+func TestDockerRuntimeOperationsAgree(t *testing.T) {
+	Register()
+
+	const op = "test_operation"
+	errorType := classifyError(errors.New("connection refused"))
+
+	recordOperation := RecordOperation(op)
+	recordOperation(errors.New("connection refused"))
+
+	expected := strings.NewReader(`
+		# HELP kubelet_docker_operations_total [ALPHA] Cumulative number of Docker operations by operation type.
+		# TYPE kubelet_docker_operations_total counter
+		kubelet_docker_operations_total{operation_type="` + op + `"} 1
+		# HELP kubelet_docker_operations_errors_total [ALPHA] Cumulative number of Docker operation errors by operation type and error type.
+		# TYPE kubelet_docker_operations_errors_total counter
+		kubelet_docker_operations_errors_total{error_type="` + errorType + `",operation_type="` + op + `"} 1
+		# HELP kubelet_runtime_operations_total [ALPHA] Cumulative number of runtime operations by runtime and operation type.
+		# TYPE kubelet_runtime_operations_total counter
+		kubelet_runtime_operations_total{operation_type="` + op + `",runtime="docker"} 1
+		# HELP kubelet_runtime_operations_errors_total [ALPHA] Cumulative number of runtime operation errors by runtime, operation type, and error type.
+		# TYPE kubelet_runtime_operations_errors_total counter
+		kubelet_runtime_operations_errors_total{error_type="` + errorType + `",operation_type="` + op + `",runtime="docker"} 1
+	`)
+
+	if err := testutil.GatherAndCompare(legacyregistry.DefaultGatherer, expected,
+		kubeletSubsystem+"_"+DockerOperationsKey, kubeletSubsystem+"_"+DockerOperationsErrorsKey,
+		kubeletSubsystem+"_"+RuntimeOperationsKey, kubeletSubsystem+"_"+RuntimeOperationsErrorsKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRecordOperationTracksInFlight verifies that DockerOperationsInFlight
+// is incremented while an operation is running and decremented once its
+// recording closure is invoked, regardless of the outcome.
+func TestRecordOperationTracksInFlight(t *testing.T) {
+	const op = "test_in_flight"
+
+	before, err := testutil.GetGaugeMetricValue(DockerOperationsInFlight.WithLabelValues(op))
+	if err != nil {
+		t.Fatalf("failed to read DockerOperationsInFlight before the operation started: %v", err)
+	}
+
+	record := RecordOperation(op)
+
+	during, err := testutil.GetGaugeMetricValue(DockerOperationsInFlight.WithLabelValues(op))
+	if err != nil {
+		t.Fatalf("failed to read DockerOperationsInFlight while the operation was running: %v", err)
+	}
+	if during != before+1 {
+		t.Errorf("DockerOperationsInFlight = %v while running, want %v", during, before+1)
+	}
+
+	record(nil)
+
+	after, err := testutil.GetGaugeMetricValue(DockerOperationsInFlight.WithLabelValues(op))
+	if err != nil {
+		t.Fatalf("failed to read DockerOperationsInFlight after the operation completed: %v", err)
+	}
+	if after != before {
+		t.Errorf("DockerOperationsInFlight = %v after completion, want %v", after, before)
+	}
+}
+
+// TestRecordOperationWithDeadlineObservesRatio verifies that
+// RecordOperationWithDeadline records a sample into
+// DockerOperationDeadlineConsumedRatio for the operation it wraps.
+func TestRecordOperationWithDeadlineObservesRatio(t *testing.T) {
+	const op = "test_deadline"
+
+	before, err := testutil.GetHistogramMetricCount(DockerOperationDeadlineConsumedRatio.WithLabelValues(op))
+	if err != nil {
+		t.Fatalf("failed to read DockerOperationDeadlineConsumedRatio before recording: %v", err)
+	}
+
+	record := RecordOperationWithDeadline(op, time.Second)
+	record(nil)
+
+	after, err := testutil.GetHistogramMetricCount(DockerOperationDeadlineConsumedRatio.WithLabelValues(op))
+	if err != nil {
+		t.Fatalf("failed to read DockerOperationDeadlineConsumedRatio after recording: %v", err)
+	}
+	if after != before+1 {
+		t.Errorf("DockerOperationDeadlineConsumedRatio sample count = %v, want %v", after, before+1)
+	}
+}